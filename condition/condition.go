@@ -0,0 +1,138 @@
+// Package condition implements the small `if:` expression language shared by
+// gohangout's filters and outputs: a config-level list of strings like
+// `EQ(log_topic, "nginx")` or `Exist(message)`, each parsed into a Condition
+// and ANDed together to decide whether an event is processed at all.
+package condition
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/golang/glog"
+)
+
+// Condition reports whether event should be processed further.
+type Condition interface {
+	Pass(event map[string]interface{}) bool
+}
+
+// eqCondition passes when event[field] equals value once both are rendered
+// as strings, so it works the same whether the event field is a string,
+// number or bool.
+type eqCondition struct {
+	field string
+	value string
+}
+
+func (c *eqCondition) Pass(event map[string]interface{}) bool {
+	v, ok := event[c.field]
+	if !ok {
+		return false
+	}
+	return fmt.Sprintf("%v", v) == c.value
+}
+
+// existCondition passes when field is present in the event and non-nil.
+type existCondition struct {
+	field string
+}
+
+func (c *existCondition) Pass(event map[string]interface{}) bool {
+	v, ok := event[c.field]
+	return ok && v != nil
+}
+
+// splitTopLevel splits raw on commas, but ignores commas inside a
+// double-quoted span, so `message, "hello, world"` splits into two
+// arguments rather than three.
+func splitTopLevel(raw string) []string {
+	var parts []string
+	var buf strings.Builder
+	inQuotes := false
+
+	for i := 0; i < len(raw); i++ {
+		ch := raw[i]
+		switch {
+		case ch == '"' && (i == 0 || raw[i-1] != '\\'):
+			inQuotes = !inQuotes
+			buf.WriteByte(ch)
+		case ch == ',' && !inQuotes:
+			parts = append(parts, buf.String())
+			buf.Reset()
+		default:
+			buf.WriteByte(ch)
+		}
+	}
+	parts = append(parts, buf.String())
+	return parts
+}
+
+// parseArgs splits "a, \"b\"" into ["a", "b"], trimming whitespace and a
+// single layer of surrounding double quotes from each argument. Commas
+// inside a quoted argument (e.g. a log line matched verbatim) do not split
+// it further.
+func parseArgs(raw string) []string {
+	parts := splitTopLevel(raw)
+	args := make([]string, len(parts))
+	for i, p := range parts {
+		p = strings.TrimSpace(p)
+		if len(p) >= 2 && p[0] == '"' && p[len(p)-1] == '"' {
+			if unquoted, err := strconv.Unquote(p); err == nil {
+				p = unquoted
+			}
+		}
+		args[i] = p
+	}
+	return args
+}
+
+// Parse parses a single `if:` entry such as `EQ(log_topic, "nginx")` into a
+// Condition. It glog.Fatalf's on malformed input, matching the rest of
+// gohangout's config-time validation.
+func Parse(expr string) Condition {
+	expr = strings.TrimSpace(expr)
+
+	open := strings.IndexByte(expr, '(')
+	if open < 0 || !strings.HasSuffix(expr, ")") {
+		glog.Fatalf("invalid condition expression: %q", expr)
+	}
+	name := strings.TrimSpace(expr[:open])
+	args := parseArgs(expr[open+1 : len(expr)-1])
+
+	switch name {
+	case "EQ":
+		if len(args) != 2 {
+			glog.Fatalf("EQ condition needs 2 arguments, got %q", expr)
+		}
+		return &eqCondition{field: args[0], value: args[1]}
+	case "Exist":
+		if len(args) != 1 {
+			glog.Fatalf("Exist condition needs 1 argument, got %q", expr)
+		}
+		return &existCondition{field: args[0]}
+	default:
+		glog.Fatalf("unknown condition %q in expression %q", name, expr)
+	}
+	return nil
+}
+
+// Build parses every entry in an `if:` config list into Conditions, in order.
+func Build(ifConfig []interface{}) []Condition {
+	conditions := make([]Condition, 0, len(ifConfig))
+	for _, v := range ifConfig {
+		conditions = append(conditions, Parse(v.(string)))
+	}
+	return conditions
+}
+
+// Pass reports whether event satisfies every condition (AND semantics). An
+// empty condition list always passes.
+func Pass(conditions []Condition, event map[string]interface{}) bool {
+	for _, c := range conditions {
+		if !c.Pass(event) {
+			return false
+		}
+	}
+	return true
+}
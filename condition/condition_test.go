@@ -0,0 +1,129 @@
+package condition
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitTopLevel(t *testing.T) {
+	cases := []struct {
+		name string
+		raw  string
+		want []string
+	}{
+		{
+			name: "simple",
+			raw:  "message, \"hello\"",
+			want: []string{"message", " \"hello\""},
+		},
+		{
+			name: "comma inside quotes is not a split point",
+			raw:  "message, \"hello, world\"",
+			want: []string{"message", " \"hello, world\""},
+		},
+		{
+			name: "multiple quoted commas",
+			raw:  "a, \"b, c\", \"d, e\"",
+			want: []string{"a", " \"b, c\"", " \"d, e\""},
+		},
+		{
+			name: "no commas",
+			raw:  "message",
+			want: []string{"message"},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got := splitTopLevel(c.raw)
+			if !reflect.DeepEqual(got, c.want) {
+				t.Errorf("splitTopLevel(%q) = %#v, want %#v", c.raw, got, c.want)
+			}
+		})
+	}
+}
+
+func TestParseArgs(t *testing.T) {
+	cases := []struct {
+		name string
+		raw  string
+		want []string
+	}{
+		{
+			name: "trims whitespace and quotes",
+			raw:  `log_topic, "nginx"`,
+			want: []string{"log_topic", "nginx"},
+		},
+		{
+			name: "comma inside a quoted arg survives",
+			raw:  `message, "GET /foo, bar HTTP/1.1"`,
+			want: []string{"message", "GET /foo, bar HTTP/1.1"},
+		},
+		{
+			name: "single unquoted arg",
+			raw:  "message",
+			want: []string{"message"},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got := parseArgs(c.raw)
+			if !reflect.DeepEqual(got, c.want) {
+				t.Errorf("parseArgs(%q) = %#v, want %#v", c.raw, got, c.want)
+			}
+		})
+	}
+}
+
+func TestParseEQ(t *testing.T) {
+	c := Parse(`EQ(log_topic, "nginx")`)
+
+	if !c.Pass(map[string]interface{}{"log_topic": "nginx"}) {
+		t.Error("expected EQ condition to pass on matching field")
+	}
+	if c.Pass(map[string]interface{}{"log_topic": "other"}) {
+		t.Error("expected EQ condition to fail on non-matching field")
+	}
+	if c.Pass(map[string]interface{}{}) {
+		t.Error("expected EQ condition to fail when field is missing")
+	}
+}
+
+func TestParseExist(t *testing.T) {
+	c := Parse(`Exist(message)`)
+
+	if !c.Pass(map[string]interface{}{"message": "hi"}) {
+		t.Error("expected Exist condition to pass when field is present")
+	}
+	if c.Pass(map[string]interface{}{"message": nil}) {
+		t.Error("expected Exist condition to fail when field is nil")
+	}
+	if c.Pass(map[string]interface{}{}) {
+		t.Error("expected Exist condition to fail when field is missing")
+	}
+}
+
+func TestBuildAndPass(t *testing.T) {
+	conditions := Build([]interface{}{
+		`EQ(log_topic, "nginx")`,
+		`Exist(message)`,
+	})
+
+	if len(conditions) != 2 {
+		t.Fatalf("expected 2 conditions, got %d", len(conditions))
+	}
+
+	if !Pass(conditions, map[string]interface{}{"log_topic": "nginx", "message": "hi"}) {
+		t.Error("expected event matching every condition to pass")
+	}
+	if Pass(conditions, map[string]interface{}{"log_topic": "nginx"}) {
+		t.Error("expected event missing a condition's field to fail")
+	}
+}
+
+func TestPassEmptyConditions(t *testing.T) {
+	if !Pass(nil, map[string]interface{}{}) {
+		t.Error("expected an empty condition list to always pass")
+	}
+}
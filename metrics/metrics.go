@@ -0,0 +1,155 @@
+// Package metrics is the process-wide Prometheus metrics registry and
+// /metrics HTTP server for gohangout. Outputs register their own counters,
+// histograms and gauges against the collectors exposed here rather than
+// each standing up their own listener.
+package metrics
+
+import (
+	"net/http"
+	"sync"
+
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	// EventsReceived counts events handed to Output.Emit, before any
+	// filtering or batching.
+	EventsReceived = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "gohangout_output_events_received_total",
+		Help: "Total events received by an output.",
+	}, []string{"output"})
+
+	// EventsFiltered counts events received but dropped by the output's
+	// `if`/`log_topic` conditions before ever entering the buffer.
+	EventsFiltered = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "gohangout_output_events_filtered_total",
+		Help: "Total events received but skipped by an output's if conditions.",
+	}, []string{"output"})
+
+	// EventsCommitted counts events that were successfully written to the
+	// downstream store.
+	EventsCommitted = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "gohangout_output_events_committed_total",
+		Help: "Total events successfully committed by an output.",
+	}, []string{"output"})
+
+	// EventsDropped counts events that could not be written and could not
+	// be spooled either (spool disabled, full, or itself erroring), plus
+	// events shed from a full in-memory buffer (shed_oldest_on_full).
+	EventsDropped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "gohangout_output_events_dropped_total",
+		Help: "Total events dropped by an output: shed from a full buffer, or unwritable to every host and the spool.",
+	}, []string{"output"})
+
+	// EventsRetried counts events that failed a write and were handed off
+	// to the spool (or the spool reaper) for a later retry.
+	EventsRetried = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "gohangout_output_events_retried_total",
+		Help: "Total events spooled for retry after a write failure.",
+	}, []string{"output"})
+
+	// BatchSize is the distribution of batch sizes handed to a flush.
+	BatchSize = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "gohangout_output_batch_size",
+		Help:    "Number of events per flushed batch.",
+		Buckets: prometheus.ExponentialBuckets(8, 2, 12), // 8 .. ~16k
+	}, []string{"output"})
+
+	// FlushDuration is how long one flush (one batch, one host attempt
+	// loop) took, successful or not.
+	FlushDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "gohangout_output_flush_duration_seconds",
+		Help:    "Time spent flushing one batch to the downstream store.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"output"})
+
+	// BufferedEvents is the current size of the in-memory buffer
+	// (len(c.events)) an output is accumulating before its next flush.
+	BufferedEvents = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "gohangout_output_buffered_events",
+		Help: "Events currently buffered in memory, waiting for the next flush.",
+	}, []string{"output"})
+
+	// BulkChanDepth is how many already-cut batches are queued waiting for
+	// a free flush worker.
+	BulkChanDepth = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "gohangout_output_bulk_chan_depth",
+		Help: "Batches queued waiting for a flush worker.",
+	}, []string{"output"})
+
+	// HostWeight is the current weight of one host in an output's
+	// HostSelector (0 means the host is effectively unusable).
+	HostWeight = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "gohangout_output_host_weight",
+		Help: "Current weight of a host in the output's selector.",
+	}, []string{"output", "host"})
+
+	// HostCircuitState is 0 (closed), 1 (half-open) or 2 (open) for each
+	// host in an output's HostSelector.
+	HostCircuitState = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "gohangout_output_host_circuit_state",
+		Help: "Circuit breaker state of a host: 0=closed, 1=half-open, 2=open.",
+	}, []string{"output", "host"})
+
+	// SpoolDepthBytes is the current on-disk size of an output's spool.
+	SpoolDepthBytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "gohangout_output_spool_depth_bytes",
+		Help: "Bytes currently held in an output's on-disk spool.",
+	}, []string{"output"})
+)
+
+func init() {
+	prometheus.MustRegister(
+		EventsReceived,
+		EventsFiltered,
+		EventsCommitted,
+		EventsDropped,
+		EventsRetried,
+		BatchSize,
+		FlushDuration,
+		BufferedEvents,
+		BulkChanDepth,
+		HostWeight,
+		HostCircuitState,
+		SpoolDepthBytes,
+	)
+}
+
+var (
+	startOnce   sync.Once
+	startedAddr string
+)
+
+// StartServer starts the process-wide /metrics and /healthz HTTP listener
+// on addr. It is safe to call from every output that has a `metrics`
+// section configured: only the first call wins, matching the "single
+// process-wide listener" requirement regardless of how many outputs ask
+// for one. Every later call is a no-op, and logs a warning if it asked for
+// a different addr than the one that actually won.
+func StartServer(addr string) {
+	alreadyStarted := true
+	startOnce.Do(func() {
+		alreadyStarted = false
+		startedAddr = addr
+
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", promhttp.Handler())
+		mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte("ok"))
+		})
+
+		go func() {
+			glog.Infof("metrics server listening on %s", addr)
+			if err := http.ListenAndServe(addr, mux); err != nil {
+				glog.Errorf("metrics server error: %s", err)
+			}
+		}()
+	})
+
+	if alreadyStarted && addr != startedAddr {
+		glog.Warningf("metrics server already listening on %s; ignoring conflicting listen %s", startedAddr, addr)
+	}
+}
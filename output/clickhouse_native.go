@@ -0,0 +1,304 @@
+package output
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	chv2 "github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+	"github.com/childe/gohangout/metrics"
+	"github.com/golang/glog"
+)
+
+// newNativeHostSelector dials every configured host with the clickhouse-go v2
+// native protocol and wraps the resulting driver.Conn pool in the same
+// HostSelector used by the http path.
+func (c *ClickhouseOutput) newNativeHostSelector(debug bool, openDuration time.Duration, halfOpenProbes int) HostSelector {
+	conns := make([]interface{}, 0, len(c.hosts))
+	connHosts := make([]string, 0, len(c.hosts))
+
+	for _, host := range c.hosts {
+		opts := &chv2.Options{
+			Addr: []string{host},
+			Auth: chv2.Auth{
+				Database: c.getDatabase(),
+				Username: c.username,
+				Password: c.password,
+			},
+			Debug: debug,
+		}
+
+		conn, err := chv2.Open(opts)
+		if err != nil {
+			glog.Errorf("open native clickhouse connection to %s error: %s", host, err)
+			continue
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		err = conn.Ping(ctx)
+		cancel()
+		if err != nil {
+			glog.Errorf("ping native clickhouse connection %s error: %s", host, err)
+			continue
+		}
+
+		conns = append(conns, conn)
+		connHosts = append(connHosts, host)
+	}
+
+	glog.V(5).Infof("%d available native clickhouse hosts", len(conns))
+	if len(conns) == 0 {
+		glog.Fatal("no available host")
+	}
+
+	return NewRRHostSelector(conns, connHosts, 3, openDuration, halfOpenProbes)
+}
+
+// probeHostNative is the native-protocol counterpart of probeHost.
+func (c *ClickhouseOutput) probeHostNative(host interface{}) {
+	conn := host.(driver.Conn)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	rows, err := conn.Query(ctx, "SELECT 1")
+	if err == nil {
+		rows.Close()
+	}
+	cancel()
+	if err != nil {
+		glog.V(5).Infof("native health check `SELECT 1` failed: %s", err)
+		return
+	}
+	c.dbSelector.AddWeight(host)
+}
+
+// resolveDistributedTableNative is the native-protocol counterpart of
+// resolveDistributedTable.
+func (c *ClickhouseOutput) resolveDistributedTableNative() {
+	if !c.preferLocalShard {
+		return
+	}
+
+	database, table := c.getDatabase(), c.getTableName()
+
+	for i := 0; i < c.dbSelector.Size(); i++ {
+		nextdb := c.dbSelector.Next()
+		if nextdb == nil {
+			break
+		}
+		conn := nextdb.(driver.Conn)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		var engine, engineFull string
+		err := conn.QueryRow(ctx, "select engine, engine_full from system.tables where database = ? and name = ?", database, table).Scan(&engine, &engineFull)
+		cancel()
+		if err != nil {
+			glog.Errorf("query system.tables for %s.%s error: %s", database, table, err)
+			continue
+		}
+		if engine != "Distributed" {
+			return
+		}
+
+		m := distributedEngineRe.FindStringSubmatch(engineFull)
+		if m == nil {
+			glog.Errorf("could not parse Distributed engine_full %q", engineFull)
+			return
+		}
+		c.table = fmt.Sprintf("%s.%s", m[2], m[3])
+		glog.Infof("clickhouse table %s.%s is Distributed; writing to local shard table %s instead", database, table, c.table)
+		return
+	}
+}
+
+// setTableDescNative is the native-protocol counterpart of setTableDesc. It
+// uses driver.ColumnType instead of string-matching a `DESC TABLE` result
+// set over HTTP, so types unsupported by convertCkType (UUID, Decimal128/256,
+// Array(*), Map, Tuple, Nested, DateTime64(N), LowCardinality(*)) come
+// through as their real ClickHouse type name.
+func (c *ClickhouseOutput) setTableDescNative() {
+	c.resolveDistributedTableNative()
+
+	c.desc = make(map[string]*rowDesc)
+
+	query := fmt.Sprintf("select * from %s where 1 = 0", c.table)
+	glog.V(5).Info(query)
+
+	for i := 0; i < c.dbSelector.Size(); i++ {
+		nextdb := c.dbSelector.Next()
+		if nextdb == nil {
+			break
+		}
+		conn := nextdb.(driver.Conn)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		rows, err := conn.Query(ctx, query)
+		cancel()
+		if err != nil {
+			glog.Errorf("query %q error: %s", query, err)
+			continue
+		}
+
+		for _, ct := range rows.ColumnTypes() {
+			c.desc[ct.Name()] = &rowDesc{
+				Name: ct.Name(),
+				Type: ct.DatabaseTypeName(),
+			}
+		}
+		rows.Close()
+
+		return
+	}
+}
+
+// innerFlushNative appends one row per event to the prepared batch via
+// batch.Append, then Sends the whole batch in one round trip over the
+// native protocol. (batch.Column(i).Append expects a concrete slice type
+// per column - []string, []uint32, []time.Time, etc. - so building a single
+// []interface{} per column and handing it to Append is not an option here;
+// the per-row Append API takes interface{} values directly.)
+func (c *ClickhouseOutput) innerFlushNative(ckb *ckBatch) {
+	events := ckb.events
+
+	start := time.Now()
+	defer func() {
+		metrics.FlushDuration.WithLabelValues(c.name).Observe(time.Since(start).Seconds())
+	}()
+	metrics.BatchSize.WithLabelValues(c.name).Observe(float64(len(events)))
+
+	execution_id := atomic.AddUint64(&c.execution_id, 1)
+	glog.Infof("write %d docs to clickhouse (native) with execution_id %d", len(events), execution_id)
+
+	for attempt := 0; attempt < c.dbSelector.Size(); attempt++ {
+		nextdb := c.dbSelector.Next()
+		if nextdb == nil {
+			glog.Warningf("no available clickhouse host, every host is circuit-open")
+			break
+		}
+		conn := nextdb.(driver.Conn)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		if c.asyncInsert {
+			settings := make(chv2.Settings, len(c.asyncInsertSettings))
+			for k, v := range c.asyncInsertSettings {
+				settings[k] = v
+			}
+			ctx = chv2.Context(ctx, chv2.WithSettings(settings))
+		}
+		nativeBatch, err := conn.PrepareBatch(ctx, c.query)
+		if err != nil {
+			cancel()
+			glog.Errorf("native prepare batch error: %s", err)
+			c.dbSelector.ReduceWeight(nextdb)
+			continue
+		}
+
+		var appendErr error
+		for _, event := range events {
+			row := make([]interface{}, c.fieldsLength)
+			for i, field := range c.fields {
+				var v interface{}
+				if v1, ok := event[field]; ok && v1 != nil {
+					ct := c.desc[field]
+					v2, err := convertCkTypeNative(ct.Type, v1)
+					if err == nil {
+						v = v2
+					} else {
+						v = v1
+					}
+				} else if v3, ok := c.defaultValue[field]; ok {
+					v = v3
+				} else {
+					v = ""
+				}
+				row[i] = v
+			}
+			if err := nativeBatch.Append(row...); err != nil {
+				appendErr = err
+				break
+			}
+		}
+		if appendErr != nil {
+			cancel()
+			glog.Errorf("native batch row append error: %s", appendErr)
+			c.dbSelector.ReduceWeight(nextdb)
+			continue
+		}
+
+		if err := nativeBatch.Send(); err != nil {
+			cancel()
+			glog.Errorf("native batch send error: %s", err)
+			c.dbSelector.ReduceWeight(nextdb)
+			continue
+		}
+		cancel()
+
+		c.dbSelector.AddWeight(nextdb)
+		metrics.EventsCommitted.WithLabelValues(c.name).Add(float64(len(events)))
+		glog.Infof("%d docs has been committed to clickhouse (native)", len(events))
+		return
+	}
+
+	c.spoolBatch(&ckBatch{events: ckb.events, retries: ckb.retries + 1})
+}
+
+// convertCkTypeNative is the native-protocol counterpart of convertCkType.
+// It falls back to convertCkType for the types it already understands, and
+// adds the handful of composite/v2-only types setTableDescNative can now
+// report: UUID, DateTime64(N), Decimal128/256, LowCardinality(*) and
+// Array(*) of the scalar types above.
+func convertCkTypeNative(ckType string, val interface{}) (out interface{}, err error) {
+	switch {
+	case ckType == "UUID":
+		if s, ok := val.(string); ok {
+			return s, nil
+		}
+		return fmt.Sprintf("%v", val), nil
+
+	case strings.HasPrefix(ckType, "DateTime64"):
+		switch v := val.(type) {
+		case string:
+			return v, nil
+		default:
+			return v, nil
+		}
+
+	case strings.HasPrefix(ckType, "Decimal128") || strings.HasPrefix(ckType, "Decimal256"):
+		switch v := val.(type) {
+		case string:
+			return v, nil
+		default:
+			return v, nil
+		}
+
+	case strings.HasPrefix(ckType, "LowCardinality("):
+		inner := strings.TrimSuffix(strings.TrimPrefix(ckType, "LowCardinality("), ")")
+		return convertCkTypeNative(inner, val)
+
+	case strings.HasPrefix(ckType, "Array("):
+		inner := strings.TrimSuffix(strings.TrimPrefix(ckType, "Array("), ")")
+		values, ok := val.([]interface{})
+		if !ok {
+			return val, nil
+		}
+		out := make([]interface{}, len(values))
+		for i, v := range values {
+			cv, cerr := convertCkTypeNative(inner, v)
+			if cerr != nil {
+				return val, cerr
+			}
+			out[i] = cv
+		}
+		return out, nil
+
+	case strings.HasPrefix(ckType, "Map(") || strings.HasPrefix(ckType, "Tuple(") || strings.HasPrefix(ckType, "Nested("):
+		// TODO: Map/Tuple/Nested are passed through as-is for now; the
+		// caller's value must already be shaped the way clickhouse-go v2
+		// expects (map[K]V / []interface{}).
+		return val, nil
+	}
+
+	return convertCkType(ckType, val)
+}
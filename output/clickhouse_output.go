@@ -4,7 +4,10 @@ import (
 	"database/sql"
 	"encoding/json"
 	"fmt"
+	"hash/fnv"
 	"math/rand"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -12,6 +15,8 @@ import (
 	"time"
 
 	clickhouse "github.com/ClickHouse/clickhouse-go"
+	"github.com/childe/gohangout/condition"
+	"github.com/childe/gohangout/metrics"
 	"github.com/childe/gohangout/topology"
 	"github.com/golang/glog"
 )
@@ -19,8 +24,36 @@ import (
 const (
 	CLICKHOUSE_DEFAULT_BULK_ACTIONS   = 1000
 	CLICKHOUSE_DEFAULT_FLUSH_INTERVAL = 30
+
+	CLICKHOUSE_PROTOCOL_HTTP   = "http"
+	CLICKHOUSE_PROTOCOL_NATIVE = "native"
+
+	CLICKHOUSE_DEFAULT_MAX_RETRIES = 10
+
+	CLICKHOUSE_DEFAULT_HEALTH_CHECK_INTERVAL = 10
+
+	// CLICKHOUSE_DEFAULT_ASYNC_INSERT_BULK_ACTIONS is the default
+	// bulk_actions when async_insert is on: the server does the
+	// coalescing, so gohangout can flush much smaller batches.
+	CLICKHOUSE_DEFAULT_ASYNC_INSERT_BULK_ACTIONS = 100
 )
 
+// distributedEngineRe pulls the underlying database and table out of a
+// Distributed table's `engine_full`, e.g.
+// `Distributed('cluster', 'db', 'table', rand())` -> db, table.
+var distributedEngineRe = regexp.MustCompile(`^Distributed\('?([^',]+)'?,\s*'?([^',]+)'?,\s*'?([^',\)]+)'?`)
+
+// asyncInsertDefaultSettings are applied server-side when async_insert is
+// enabled and async_insert_settings doesn't override them. Unlike a
+// `SETTINGS` clause tacked onto the query string, these are never parsed
+// out by clickhouse-go: they're sent per-query via the native protocol's
+// settings context (innerFlushNative) or as DSN query parameters over HTTP
+// (newClickhouseOutput).
+var asyncInsertDefaultSettings = map[string]interface{}{
+	"async_insert":          1,
+	"wait_for_async_insert": 0,
+}
+
 type ClickhouseOutput struct {
 	config map[interface{}]interface{}
 
@@ -32,24 +65,83 @@ type ClickhouseOutput struct {
 	password     string
 	logTopic     string
 
+	// conditions gates Emit: an event that doesn't pass every condition is
+	// dropped before it ever enters the buffer. Built from the `if` config
+	// list, with `log_topic` expanding into a leading EQ condition.
+	conditions []condition.Condition
+
+	// name labels this output's metrics; defaults to table.
+	name string
+
+	// protocol selects the wire protocol used to talk to ClickHouse.
+	// "http" (default) goes through database/sql + clickhouse-go v1,
+	// "native" goes through clickhouse-go v2's native TCP protocol
+	// and is handled by the functions in clickhouse_native.go.
+	protocol string
+
 	fieldsLength int
 	query        string
 	desc         map[string]*rowDesc
 	defaultValue map[string]interface{} // columnName -> defaultValue
 
-	bulkChan   chan []map[string]interface{}
+	// asyncInsert has ClickHouse coalesce inserts server-side instead of
+	// gohangout buffering them. asyncInsertSettings is sent per-query
+	// (native: settings context, http: DSN query parameters) rather than
+	// appended to c.query, since clickhouse-go discards anything after
+	// `VALUES (` in the query string.
+	asyncInsert         bool
+	asyncInsertSettings map[string]interface{}
+
+	// preferLocalShard rewrites c.table from a Distributed table to the
+	// local table it fans out to, once setTableDesc resolves one via
+	// system.tables, so writes go straight to the shard replica.
+	preferLocalShard bool
+
+	bulkChan   chan *ckBatch
 	concurrent int
 
-	events       []map[string]interface{}
+	events        []map[string]interface{}
+	bufferedBytes int64 // running estimate of events' serialized size, guarded by mux
+
+	// bulkSizeBytes forces a flush once bufferedBytes reaches it, in
+	// addition to the bulk_actions count trigger; 0 disables it.
+	bulkSizeBytes int64
+	// maxBufferedBytes is a hard cap: Emit forces a flush (and, via
+	// bulkChan backpressure, blocks) once it is reached. If
+	// shedOldestOnFull is set, the oldest buffered events are first
+	// dropped to make room for the new one; a flush is then forced only
+	// if the buffer still reaches the cap. A bulk_actions or
+	// bulk_size_bytes flush can block Emit either way. 0 disables the cap.
+	maxBufferedBytes int64
+	shedOldestOnFull bool
+
+	flushInterval time.Duration
+	flushTicker   *time.Ticker
+
 	execution_id uint64
 
-	dbSelector HostSelector
+	dbSelector          HostSelector
+	healthCheckInterval time.Duration
+
+	// spool persists batches that fail every host so a ClickHouse outage
+	// does not drop events; nil when `spool_dir` is not configured.
+	spool      *clickhouseSpool
+	maxRetries int
 
 	mux       sync.Mutex
 	wg        sync.WaitGroup
 	closeChan chan bool
 }
 
+// ckBatch is what flows through bulkChan: a batch of events plus how many
+// times it has already been retried, so the spool reaper can resubmit
+// spooled batches through the same path Emit/flush use without losing the
+// retry count.
+type ckBatch struct {
+	events  []map[string]interface{}
+	retries int
+}
+
 type rowDesc struct {
 	Name              string `json:"name"`
 	Type              string `json:"type"`
@@ -58,6 +150,13 @@ type rowDesc struct {
 }
 
 func (c *ClickhouseOutput) setTableDesc() {
+	if c.protocol == CLICKHOUSE_PROTOCOL_NATIVE {
+		c.setTableDescNative()
+		return
+	}
+
+	c.resolveDistributedTable()
+
 	c.desc = make(map[string]*rowDesc)
 
 	query := fmt.Sprintf("desc table %s", c.table)
@@ -232,6 +331,84 @@ func (c *ClickhouseOutput) getDatabase() string {
 	return dbName
 }
 
+// asyncInsertDSNParams renders asyncInsertSettings as extra DSN query
+// parameters. clickhouse-go v1 passes unrecognized DSN parameters straight
+// through as ClickHouse settings, so this is how async_insert reaches the
+// server over HTTP instead of being appended to (and dropped from) the
+// query string.
+func (c *ClickhouseOutput) asyncInsertDSNParams() string {
+	if !c.asyncInsert {
+		return ""
+	}
+	var b strings.Builder
+	for k, v := range c.asyncInsertSettings {
+		fmt.Fprintf(&b, "&%s=%v", k, v)
+	}
+	return b.String()
+}
+
+func (c *ClickhouseOutput) getTableName() string {
+	dbAndTable := strings.Split(c.table, ".")
+	if len(dbAndTable) == 2 {
+		return dbAndTable[1]
+	}
+	return c.table
+}
+
+// resolveLocalTable looks table up in system.tables and, if it is a
+// Distributed table, returns the local database/table named in its
+// engine_full. err is non-nil only on a query/parse failure, so the caller
+// can tell "try the next host" apart from "not Distributed".
+func resolveLocalTable(db *sql.DB, database, table string) (localDatabase, localTable string, ok bool, err error) {
+	row := db.QueryRow("select engine, engine_full from system.tables where database = ? and name = ?", database, table)
+
+	var engine, engineFull string
+	if err := row.Scan(&engine, &engineFull); err != nil {
+		return "", "", false, err
+	}
+	if engine != "Distributed" {
+		return "", "", false, nil
+	}
+
+	m := distributedEngineRe.FindStringSubmatch(engineFull)
+	if m == nil {
+		return "", "", false, fmt.Errorf("could not parse Distributed engine_full %q", engineFull)
+	}
+	return m[2], m[3], true, nil
+}
+
+// resolveDistributedTable rewrites c.table to the local shard table when
+// preferLocalShard is set and c.table turns out to be Distributed, so
+// setTableDesc and every later INSERT write straight to the shard replica
+// instead of fanning out through the Distributed table.
+func (c *ClickhouseOutput) resolveDistributedTable() {
+	if !c.preferLocalShard {
+		return
+	}
+
+	database, table := c.getDatabase(), c.getTableName()
+
+	for i := 0; i < c.dbSelector.Size(); i++ {
+		nextdb := c.dbSelector.Next()
+		if nextdb == nil {
+			break
+		}
+		db := nextdb.(*sql.DB)
+
+		localDatabase, localTable, ok, err := resolveLocalTable(db, database, table)
+		if err != nil {
+			glog.Errorf("query system.tables for %s.%s error: %s", database, table, err)
+			continue
+		}
+		if !ok {
+			return
+		}
+		c.table = fmt.Sprintf("%s.%s", localDatabase, localTable)
+		glog.Infof("clickhouse table %s.%s is Distributed; writing to local shard table %s instead", database, table, c.table)
+		return
+	}
+}
+
 func init() {
 	Register("Clickhouse", newClickhouseOutput)
 }
@@ -248,6 +425,21 @@ func newClickhouseOutput(config map[interface{}]interface{}) topology.Output {
 		glog.Fatalf("table must be set in clickhouse output")
 	}
 
+	if v, ok := config["name"]; ok {
+		p.name = v.(string)
+	} else {
+		p.name = p.table
+	}
+
+	if v, ok := config["metrics"]; ok {
+		metricsConfig := v.(map[interface{}]interface{})
+		listen := ":9600"
+		if l, ok := metricsConfig["listen"]; ok {
+			listen = l.(string)
+		}
+		metrics.StartServer(listen)
+	}
+
 	if v, ok := config["hosts"]; ok {
 		for _, h := range v.([]interface{}) {
 			p.hosts = append(p.hosts, h.(string))
@@ -268,12 +460,33 @@ func newClickhouseOutput(config map[interface{}]interface{}) topology.Output {
 	if v, ok := config["debug"]; ok {
 		debug = v.(bool)
 	}
-	/* 22.3.7支持kafka消息频道
-	 */
+	// log_topic is sugar for an `EQ(log_topic, ...)` condition, kept for
+	// backward compatibility with configs that predate `if`.
 	if v, ok := config["log_topic"]; ok {
 		p.logTopic = v.(string)
-	} else {
-		glog.Fatalf("kafka_topic must be set in clickhouse output")
+		p.conditions = append(p.conditions, condition.Parse(fmt.Sprintf("EQ(log_topic, %q)", p.logTopic)))
+	}
+	if v, ok := config["if"]; ok {
+		p.conditions = append(p.conditions, condition.Build(v.([]interface{}))...)
+	}
+
+	if v, ok := config["async_insert"]; ok {
+		p.asyncInsert = v.(bool)
+	}
+	if p.asyncInsert {
+		p.asyncInsertSettings = make(map[string]interface{}, len(asyncInsertDefaultSettings))
+		for k, v := range asyncInsertDefaultSettings {
+			p.asyncInsertSettings[k] = v
+		}
+		if v, ok := config["async_insert_settings"]; ok {
+			for k, val := range v.(map[interface{}]interface{}) {
+				p.asyncInsertSettings[k.(string)] = val
+			}
+		}
+	}
+
+	if v, ok := config["prefer_local_shard"]; ok {
+		p.preferLocalShard = v.(bool)
 	}
 
 	/* 2022.3.2注释：支持动态字段
@@ -305,36 +518,64 @@ func newClickhouseOutput(config map[interface{}]interface{}) topology.Output {
 		connMaxLifetime = v.(int)
 	}
 
-	dbs := make([]*sql.DB, 0)
+	if v, ok := config["protocol"]; ok {
+		p.protocol = v.(string)
+	} else {
+		p.protocol = CLICKHOUSE_PROTOCOL_HTTP
+	}
 
-	for _, host := range p.hosts {
-		dataSourceName := fmt.Sprintf("%s?database=%s&username=%s&password=%s&debug=%v", host, p.getDatabase(), p.username, p.password, debug)
-		if db, err := sql.Open("clickhouse", dataSourceName); err == nil {
-			if err := db.Ping(); err != nil {
-				if exception, ok := err.(*clickhouse.Exception); ok {
-					glog.Errorf("[%d] %s \n%s\n", exception.Code, exception.Message, exception.StackTrace)
+	openDuration := CLICKHOUSE_DEFAULT_OPEN_DURATION * time.Second
+	if v, ok := config["open_duration"]; ok {
+		openDuration = time.Duration(v.(int)) * time.Second
+	}
+	halfOpenProbes := CLICKHOUSE_DEFAULT_HALF_OPEN_PROBES
+	if v, ok := config["half_open_probes"]; ok {
+		halfOpenProbes = v.(int)
+	}
+	p.healthCheckInterval = CLICKHOUSE_DEFAULT_HEALTH_CHECK_INTERVAL * time.Second
+	if v, ok := config["health_check_interval"]; ok {
+		p.healthCheckInterval = time.Duration(v.(int)) * time.Second
+	}
+
+	switch p.protocol {
+	case CLICKHOUSE_PROTOCOL_NATIVE:
+		p.dbSelector = p.newNativeHostSelector(debug, openDuration, halfOpenProbes)
+	case CLICKHOUSE_PROTOCOL_HTTP:
+		dbs := make([]*sql.DB, 0)
+		dbHosts := make([]string, 0)
+
+		for _, host := range p.hosts {
+			dataSourceName := fmt.Sprintf("%s?database=%s&username=%s&password=%s&debug=%v%s", host, p.getDatabase(), p.username, p.password, debug, p.asyncInsertDSNParams())
+			if db, err := sql.Open("clickhouse", dataSourceName); err == nil {
+				if err := db.Ping(); err != nil {
+					if exception, ok := err.(*clickhouse.Exception); ok {
+						glog.Errorf("[%d] %s \n%s\n", exception.Code, exception.Message, exception.StackTrace)
+					} else {
+						glog.Errorf("clickhouse ping error: %s", err)
+					}
 				} else {
-					glog.Errorf("clickhouse ping error: %s", err)
+					db.SetConnMaxLifetime(time.Second * time.Duration(connMaxLifetime))
+					dbs = append(dbs, db)
+					dbHosts = append(dbHosts, host)
 				}
 			} else {
-				db.SetConnMaxLifetime(time.Second * time.Duration(connMaxLifetime))
-				dbs = append(dbs, db)
+				glog.Errorf("open %s error: %s", host, err)
 			}
-		} else {
-			glog.Errorf("open %s error: %s", host, err)
 		}
-	}
 
-	glog.V(5).Infof("%d available clickhouse hosts", len(dbs))
-	if len(dbs) == 0 {
-		glog.Fatal("no available host")
-	}
+		glog.V(5).Infof("%d available clickhouse hosts", len(dbs))
+		if len(dbs) == 0 {
+			glog.Fatal("no available host")
+		}
 
-	dbsI := make([]interface{}, len(dbs))
-	for i, h := range dbs {
-		dbsI[i] = h
+		dbsI := make([]interface{}, len(dbs))
+		for i, h := range dbs {
+			dbsI[i] = h
+		}
+		p.dbSelector = NewRRHostSelector(dbsI, dbHosts, 3, openDuration, halfOpenProbes)
+	default:
+		glog.Fatalf("unknown clickhouse protocol: %s. must be %q or %q", p.protocol, CLICKHOUSE_PROTOCOL_HTTP, CLICKHOUSE_PROTOCOL_NATIVE)
 	}
-	p.dbSelector = NewRRHostSelector(dbsI, 3)
 
 	p.setColumnDefault()
 	/* 2022.3.2 新增：支持动态字段
@@ -363,14 +604,14 @@ func newClickhouseOutput(config map[interface{}]interface{}) topology.Output {
 	p.concurrent = concurrent
 	p.closeChan = make(chan bool, concurrent)
 
-	p.bulkChan = make(chan []map[string]interface{}, concurrent)
+	p.bulkChan = make(chan *ckBatch, concurrent)
 	for i := 0; i < concurrent; i++ {
 		go func() {
 			p.wg.Add(1)
 			for {
 				select {
-				case events := <-p.bulkChan:
-					p.innerFlush(events)
+				case batch := <-p.bulkChan:
+					p.innerFlush(batch)
 				case <-p.closeChan:
 					p.wg.Done()
 					return
@@ -381,58 +622,104 @@ func newClickhouseOutput(config map[interface{}]interface{}) topology.Output {
 
 	if v, ok := config["bulk_actions"]; ok {
 		p.bulk_actions = v.(int)
+	} else if p.asyncInsert {
+		p.bulk_actions = CLICKHOUSE_DEFAULT_ASYNC_INSERT_BULK_ACTIONS
 	} else {
 		p.bulk_actions = CLICKHOUSE_DEFAULT_BULK_ACTIONS
 	}
 
+	if v, ok := config["bulk_size_bytes"]; ok {
+		p.bulkSizeBytes = int64(v.(int))
+	}
+	if v, ok := config["max_buffered_bytes"]; ok {
+		p.maxBufferedBytes = int64(v.(int))
+	}
+	if v, ok := config["shed_oldest_on_full"]; ok {
+		p.shedOldestOnFull = v.(bool)
+	}
+
+	if v, ok := config["max_retries"]; ok {
+		p.maxRetries = v.(int)
+	} else {
+		p.maxRetries = CLICKHOUSE_DEFAULT_MAX_RETRIES
+	}
+
+	if v, ok := config["spool_dir"]; ok {
+		spool, err := newClickhouseSpool(v.(string), p.maxRetries, config, p.bulkChan)
+		if err != nil {
+			glog.Fatalf("could not open clickhouse spool: %s", err)
+		}
+		p.spool = spool
+		go p.spool.reap()
+	}
+
 	var flush_interval int
 	if v, ok := config["flush_interval"]; ok {
 		flush_interval = v.(int)
 	} else {
 		flush_interval = CLICKHOUSE_DEFAULT_FLUSH_INTERVAL
 	}
+	p.flushInterval = time.Second * time.Duration(flush_interval)
+	p.flushTicker = time.NewTicker(p.flushInterval)
 	go func() {
-		for range time.NewTicker(time.Second * time.Duration(flush_interval)).C {
+		for range p.flushTicker.C {
 			p.flush()
 		}
 	}()
 
+	go p.healthCheckLoop()
+
 	return p
 }
 
-func (c *ClickhouseOutput) innerFlush(events []map[string]interface{}) {
+func (c *ClickhouseOutput) innerFlush(batch *ckBatch) {
+	if c.protocol == CLICKHOUSE_PROTOCOL_NATIVE {
+		c.innerFlushNative(batch)
+		return
+	}
+
+	events := batch.events
+
+	start := time.Now()
+	defer func() {
+		metrics.FlushDuration.WithLabelValues(c.name).Observe(time.Since(start).Seconds())
+	}()
+	metrics.BatchSize.WithLabelValues(c.name).Observe(float64(len(events)))
+
 	execution_id := atomic.AddUint64(&c.execution_id, 1)
 	glog.Infof("write %d docs to clickhouse with execution_id %d", len(events), execution_id)
 
-	for {
+	// Make at most Size() attempts, one per host Next() returns: a failing
+	// host is retried on a later batch rather than in a tight loop here,
+	// and an exhausted pass falls through to the spool instead of blocking
+	// forever. While some hosts are circuit-open, Next() can return the
+	// same host more than once within one pass.
+	for attempt := 0; attempt < c.dbSelector.Size(); attempt++ {
 		nextdb := c.dbSelector.Next()
-
-		/*** not ReduceWeight for now , so this should not happen
 		if nextdb == nil {
-			glog.Info("no available db, wait for 30s")
-			time.Sleep(30 * time.Second)
-			continue
+			glog.Warningf("no available clickhouse host, every host is circuit-open")
+			break
 		}
-		****/
 
-		tx, err := nextdb.(*sql.DB).Begin()
+		db := nextdb.(*sql.DB)
+
+		tx, err := db.Begin()
 		if err != nil {
 			glog.Errorf("db begin to create transaction error: %s", err)
+			c.dbSelector.ReduceWeight(nextdb)
 			continue
 		}
-		defer tx.Rollback()
 
 		stmt, err := tx.Prepare(c.query)
 		if err != nil {
 			glog.Errorf("transaction prepare statement error: %s", err)
-			return
+			tx.Rollback()
+			c.dbSelector.ReduceWeight(nextdb)
+			continue
 		}
-		defer stmt.Close()
 
+		failed := false
 		for _, event := range events {
-			/*22.3.7 过滤 kafka_topic
-			 */
-			//if topic, ok := event["log_topic"]; ok && topic == c.logTopic {
 			args := make([]interface{}, c.fieldsLength)
 			for i, field := range c.fields {
 				if v1, ok := event[field]; ok && v1 != nil {
@@ -458,18 +745,32 @@ func (c *ClickhouseOutput) innerFlush(events []map[string]interface{}) {
 			}
 			if _, err := stmt.Exec(args...); err != nil {
 				glog.Errorf("exec clickhouse insert %v error: %s", event, err)
-				return
+				failed = true
+				break
 			}
 			//}
 		}
+		stmt.Close()
+
+		if failed {
+			tx.Rollback()
+			c.dbSelector.ReduceWeight(nextdb)
+			continue
+		}
 
 		if err := tx.Commit(); err != nil {
 			glog.Errorf("exec clickhouse commit error: %s", err)
-			return
+			c.dbSelector.ReduceWeight(nextdb)
+			continue
 		}
+
+		c.dbSelector.AddWeight(nextdb)
+		metrics.EventsCommitted.WithLabelValues(c.name).Add(float64(len(events)))
 		glog.Infof("%d docs has been committed to clickhouse", len(events))
 		return
 	}
+
+	c.spoolBatch(&ckBatch{events: batch.events, retries: batch.retries + 1})
 }
 
 func (c *ClickhouseOutput) flush() {
@@ -477,28 +778,133 @@ func (c *ClickhouseOutput) flush() {
 	if len(c.events) > 0 {
 		events := c.events
 		c.events = make([]map[string]interface{}, 0, c.bulk_actions)
-		c.bulkChan <- events
+		c.bufferedBytes = 0
+		metrics.BufferedEvents.WithLabelValues(c.name).Set(0)
+		c.bulkChan <- &ckBatch{events: events}
+		metrics.BulkChanDepth.WithLabelValues(c.name).Set(float64(len(c.bulkChan)))
 	}
 	c.mux.Unlock()
 }
 
-// Emit appends event to c.events, and push to bulkChan if needed
+// estimateEventSize is a cheap stand-in for an event's serialized size: the
+// length of every field name and string value, plus a fixed cost per
+// non-string value, so Emit
+// can track bufferedBytes without re-marshaling every event.
+const estimatedFieldCost = 8
+
+func estimateEventSize(event map[string]interface{}) int64 {
+	var size int64
+	for k, v := range event {
+		size += int64(len(k))
+		if s, ok := v.(string); ok {
+			size += int64(len(s))
+		} else {
+			size += estimatedFieldCost
+		}
+	}
+	return size
+}
+
+// Emit appends event to c.events, and pushes to bulkChan once bulk_actions
+// or bulk_size_bytes is reached. max_buffered_bytes is a hard memory cap:
+// with shed_oldest_on_full, Emit first sheds the oldest buffered events to
+// make room; if the buffer still reaches the cap, Emit forces a flush,
+// which blocks via bulkChan backpressure if the downstream flush workers
+// can't keep up.
 func (c *ClickhouseOutput) Emit(event map[string]interface{}) {
+	metrics.EventsReceived.WithLabelValues(c.name).Inc()
+
+	if !condition.Pass(c.conditions, event) {
+		metrics.EventsFiltered.WithLabelValues(c.name).Inc()
+		return
+	}
+
+	size := estimateEventSize(event)
+
 	c.mux.Lock()
+
+	if c.maxBufferedBytes > 0 && c.shedOldestOnFull {
+		for len(c.events) > 0 && c.bufferedBytes+size > c.maxBufferedBytes {
+			oldest := c.events[0]
+			c.events = c.events[1:]
+			c.bufferedBytes -= estimateEventSize(oldest)
+			metrics.EventsDropped.WithLabelValues(c.name).Inc()
+		}
+	}
+
 	c.events = append(c.events, event)
-	if len(c.events) < c.bulk_actions {
+	c.bufferedBytes += size
+	metrics.BufferedEvents.WithLabelValues(c.name).Set(float64(len(c.events)))
+
+	trigger := len(c.events) >= c.bulk_actions
+	if !trigger && c.bulkSizeBytes > 0 && c.bufferedBytes >= c.bulkSizeBytes {
+		trigger = true
+	}
+	if !trigger && c.maxBufferedBytes > 0 && c.bufferedBytes >= c.maxBufferedBytes {
+		trigger = true
+	}
+
+	if !trigger {
 		c.mux.Unlock()
 		return
 	}
 
 	events := c.events
 	c.events = make([]map[string]interface{}, 0, c.bulk_actions)
+	c.bufferedBytes = 0
+	metrics.BufferedEvents.WithLabelValues(c.name).Set(0)
 	c.mux.Unlock()
 
-	c.bulkChan <- events
+	c.bulkChan <- &ckBatch{events: events}
+	metrics.BulkChanDepth.WithLabelValues(c.name).Set(float64(len(c.bulkChan)))
+
+	// A size-triggered flush shouldn't be immediately followed by the
+	// interval ticker firing too: push the next tick back out.
+	c.flushTicker.Reset(c.flushInterval)
+}
+
+// spoolBatch persists a batch that innerFlush/innerFlushNative failed to
+// write to every host. It is a no-op, preserving the old silent-drop
+// behavior, when `spool_dir` was not configured.
+func (c *ClickhouseOutput) spoolBatch(batch *ckBatch) {
+	if c.spool == nil {
+		metrics.EventsDropped.WithLabelValues(c.name).Add(float64(len(batch.events)))
+		return
+	}
+	if err := c.spool.write(c.table, c.schemaFingerprint(), batch.events, batch.retries); err != nil {
+		glog.Errorf("spool %d docs error: %s", len(batch.events), err)
+		metrics.EventsDropped.WithLabelValues(c.name).Add(float64(len(batch.events)))
+		return
+	}
+	if batch.retries < c.maxRetries {
+		// a batch at max_retries went to the poison queue, not back for a retry
+		metrics.EventsRetried.WithLabelValues(c.name).Add(float64(len(batch.events)))
+	}
+	metrics.SpoolDepthBytes.WithLabelValues(c.name).Set(float64(c.spool.size()))
+}
+
+// schemaFingerprint is a cheap, stable summary of c.desc used to flag
+// schema drift between the time a batch was spooled and the time it is
+// replayed.
+func (c *ClickhouseOutput) schemaFingerprint() string {
+	names := make([]string, 0, len(c.fields))
+	for _, field := range c.fields {
+		if d, ok := c.desc[field]; ok {
+			names = append(names, field+":"+d.Type)
+		} else {
+			names = append(names, field+":?")
+		}
+	}
+	sort.Strings(names)
+	h := fnv.New64a()
+	h.Write([]byte(strings.Join(names, ",")))
+	return strconv.FormatUint(h.Sum64(), 16)
 }
 
 func (c *ClickhouseOutput) awaitclose(timeout time.Duration) {
+	metrics.BufferedEvents.WithLabelValues(c.name).Set(0)
+	metrics.BulkChanDepth.WithLabelValues(c.name).Set(float64(len(c.bulkChan)))
+
 	exit := make(chan bool)
 	defer func() {
 		select {
@@ -529,22 +935,36 @@ func (c *ClickhouseOutput) awaitclose(timeout time.Duration) {
 		c.events = make([]map[string]interface{}, 0, c.bulk_actions)
 		c.mux.Unlock()
 
-		glog.Infof("ramain %d docs, write them to clickhouse", len(events))
-		c.wg.Add(1)
-		go func() {
-			c.innerFlush(events)
-			c.wg.Done()
-		}()
+		if c.spool != nil {
+			// Spool directly instead of racing a best-effort insert
+			// against the shutdown timeout: a batch spooled here is
+			// durable on disk and will be replayed by the reaper after
+			// restart, so we never depend on ClickHouse being reachable
+			// during shutdown.
+			glog.Infof("remain %d docs, spool them for replay", len(events))
+			c.spoolBatch(&ckBatch{events: events})
+		} else {
+			glog.Infof("ramain %d docs, write them to clickhouse", len(events))
+			c.wg.Add(1)
+			go func() {
+				c.innerFlush(&ckBatch{events: events})
+				c.wg.Done()
+			}()
+		}
 	}
 
 	glog.Info("check if there are events blocking in bulk channel")
 
 	for {
 		select {
-		case events := <-c.bulkChan:
+		case batch := <-c.bulkChan:
+			if c.spool != nil {
+				c.spoolBatch(batch)
+				continue
+			}
 			c.wg.Add(1)
 			go func() {
-				c.innerFlush(events)
+				c.innerFlush(batch)
 				c.wg.Done()
 			}()
 		default:
@@ -561,7 +981,73 @@ func (c *ClickhouseOutput) Shutdown() {
 	c.awaitclose(30 * time.Second)
 }
 
-/* 2022.3.2 新增
+// healthCheckLoop periodically probes every configured host with `SELECT 1`
+// and restores its weight on success, so a host that recovers on its own
+// (e.g. after a restart) starts receiving traffic again without waiting for
+// a write to land on it by chance.
+func (c *ClickhouseOutput) healthCheckLoop() {
+	sel, ok := c.dbSelector.(*rrHostSelector)
+	if !ok {
+		return
+	}
+
+	ticker := time.NewTicker(c.healthCheckInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		for _, host := range sel.Entries() {
+			c.probeHost(host)
+		}
+		c.reportHostMetrics()
+	}
+}
+
+// reportHostMetrics refreshes the per-host weight/circuit gauges from the
+// selector's current Stats() snapshot.
+func (c *ClickhouseOutput) reportHostMetrics() {
+	for _, stat := range c.dbSelector.Stats() {
+		metrics.HostWeight.WithLabelValues(c.name, stat.Host).Set(float64(stat.Weight))
+
+		state := 0.0
+		switch stat.State {
+		case "half-open":
+			state = 1
+		case "open":
+			state = 2
+		}
+		metrics.HostCircuitState.WithLabelValues(c.name, stat.Host).Set(state)
+	}
+}
+
+// probeHost issues `SELECT 1` against host and calls AddWeight on success.
+// It deliberately does not call ReduceWeight on failure: that is already
+// done, with better information, by innerFlush/innerFlushNative whenever a
+// real write fails.
+func (c *ClickhouseOutput) probeHost(host interface{}) {
+	if c.protocol == CLICKHOUSE_PROTOCOL_NATIVE {
+		c.probeHostNative(host)
+		return
+	}
+
+	db := host.(*sql.DB)
+	rows, err := db.Query("SELECT 1")
+	if err != nil {
+		glog.V(5).Infof("health check `SELECT 1` failed: %s", err)
+		return
+	}
+	rows.Close()
+	c.dbSelector.AddWeight(host)
+}
+
+// Stats returns a point-in-time snapshot of every host's weight and circuit
+// state, for the metrics subsystem to export.
+func (c *ClickhouseOutput) Stats() []HostStat {
+	return c.dbSelector.Stats()
+}
+
+/*
+	2022.3.2 新增
+
 ck数据类型转换
 */
 func convertCkType(ckType string, val interface{}) (out interface{}, err error) {
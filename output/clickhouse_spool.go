@@ -0,0 +1,420 @@
+package output
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+const (
+	CLICKHOUSE_DEFAULT_SPOOL_MAX_BYTES     = 1 << 30  // 1GiB
+	CLICKHOUSE_DEFAULT_SPOOL_SEGMENT_SIZE  = 64 << 20 // 64MiB per segment file
+	CLICKHOUSE_DEFAULT_SPOOL_REAP_INTERVAL = 5        // seconds
+
+	clickhouseSpoolPendingDir = "pending"
+	clickhouseSpoolPoisonDir  = "poison"
+)
+
+// spoolRecord is what gets length-prefixed and appended to a segment file.
+// It carries enough context (table + schema fingerprint) to sanity check a
+// batch at replay time even though, by then, the in-memory ClickhouseOutput
+// that wrote it may have reconnected against a changed table.
+type spoolRecord struct {
+	Table       string                   `json:"table"`
+	Schema      string                   `json:"schema"`
+	Events      []map[string]interface{} `json:"events"`
+	Retries     int                      `json:"retries"`
+	FirstSeen   int64                    `json:"first_seen"`
+	NextAttempt int64                    `json:"next_attempt"`
+}
+
+// clickhouseSpool is a disk-backed, segmented append-only log of batches
+// that innerFlush/innerFlushNative failed to write to every ClickHouse
+// host. A background reaper drains it back into the output's bulkChan with
+// exponential backoff; anything that exceeds max_retries is moved to a
+// poison subdirectory instead of being retried forever.
+type clickhouseSpool struct {
+	dir        string
+	pendingDir string
+	poisonDir  string
+
+	maxBytes   int64
+	curBytes   int64 // atomic
+	maxRetries int
+
+	backoffBase time.Duration
+	backoffCap  time.Duration
+	jitter      float64
+
+	reapInterval time.Duration
+
+	segMux     sync.Mutex
+	activeFile *os.File
+	activePath string
+	activeSize int64
+	segmentSeq int64
+
+	bulkChan chan *ckBatch
+}
+
+// newClickhouseSpool creates (or reopens) the spool rooted at dir.
+// maxRetries is the output's own parsed `max_retries` (the copy that
+// actually gates poisoning, see write()) so there is exactly one place
+// that option is read, not two that could drift apart. config is still the
+// output's raw config map for the spool's other optional knobs
+// (spool_max_bytes, spool_retry_base, spool_retry_cap, spool_reap_interval)
+// without ClickhouseOutput having to thread each one through by hand.
+func newClickhouseSpool(dir string, maxRetries int, config map[interface{}]interface{}, bulkChan chan *ckBatch) (*clickhouseSpool, error) {
+	s := &clickhouseSpool{
+		dir:          dir,
+		pendingDir:   filepath.Join(dir, clickhouseSpoolPendingDir),
+		poisonDir:    filepath.Join(dir, clickhouseSpoolPoisonDir),
+		maxBytes:     CLICKHOUSE_DEFAULT_SPOOL_MAX_BYTES,
+		maxRetries:   maxRetries,
+		backoffBase:  time.Second,
+		backoffCap:   5 * time.Minute,
+		jitter:       0.2,
+		reapInterval: CLICKHOUSE_DEFAULT_SPOOL_REAP_INTERVAL * time.Second,
+		bulkChan:     bulkChan,
+	}
+
+	if v, ok := config["spool_max_bytes"]; ok {
+		s.maxBytes = int64(v.(int))
+	}
+	if v, ok := config["spool_retry_base"]; ok {
+		s.backoffBase = time.Duration(v.(int)) * time.Second
+	}
+	if v, ok := config["spool_retry_cap"]; ok {
+		s.backoffCap = time.Duration(v.(int)) * time.Second
+	}
+	if v, ok := config["spool_reap_interval"]; ok {
+		s.reapInterval = time.Duration(v.(int)) * time.Second
+	}
+
+	for _, d := range []string{s.pendingDir, s.poisonDir} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			return nil, fmt.Errorf("create spool dir %s: %w", d, err)
+		}
+	}
+
+	entries, err := os.ReadDir(s.pendingDir)
+	if err != nil {
+		return nil, fmt.Errorf("read spool dir %s: %w", s.pendingDir, err)
+	}
+	var maxSeq int64
+	var curBytes int64
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		if info, err := e.Info(); err == nil {
+			curBytes += info.Size()
+		}
+		var seq int64
+		if _, err := fmt.Sscanf(e.Name(), "segment-%d.log", &seq); err == nil && seq > maxSeq {
+			maxSeq = seq
+		}
+	}
+	atomic.StoreInt64(&s.curBytes, curBytes)
+	// Write to a fresh segment, so every segment left by an earlier run is
+	// closed and can be drained by the reaper.
+	s.segmentSeq = maxSeq + 1
+
+	if err := s.openSegment(s.segmentSeq); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s *clickhouseSpool) segmentPath(seq int64) string {
+	return filepath.Join(s.pendingDir, fmt.Sprintf("segment-%d.log", seq))
+}
+
+func (s *clickhouseSpool) openSegment(seq int64) error {
+	path := s.segmentPath(seq)
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("open spool segment %s: %w", path, err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("stat spool segment %s: %w", path, err)
+	}
+	s.activeFile = f
+	s.activePath = path
+	s.activeSize = info.Size()
+	return nil
+}
+
+func (s *clickhouseSpool) rotateLocked() error {
+	if s.activeFile != nil {
+		s.activeFile.Close()
+	}
+	s.segmentSeq++
+	return s.openSegment(s.segmentSeq)
+}
+
+// isFull reports whether the spool has hit its configured disk budget. The
+// caller is expected to shed (drop and log) rather than write when this is
+// true, since the whole point of spooling is to bound memory, not trade it
+// for unbounded disk.
+func (s *clickhouseSpool) isFull() bool {
+	return atomic.LoadInt64(&s.curBytes) >= s.maxBytes
+}
+
+// size returns the spool's current on-disk footprint in bytes.
+func (s *clickhouseSpool) size() int64 {
+	return atomic.LoadInt64(&s.curBytes)
+}
+
+// write appends one batch to the spool, or moves it straight to the poison
+// directory if it has already exhausted its retries.
+func (s *clickhouseSpool) write(table, schema string, events []map[string]interface{}, retries int) error {
+	rec := &spoolRecord{
+		Table:     table,
+		Schema:    schema,
+		Events:    events,
+		Retries:   retries,
+		FirstSeen: time.Now().Unix(),
+	}
+
+	if rec.Retries >= s.maxRetries {
+		return s.poison(rec, fmt.Errorf("exceeded max_retries (%d)", s.maxRetries))
+	}
+
+	rec.NextAttempt = time.Now().Add(s.backoff(rec.Retries)).Unix()
+
+	if s.isFull() {
+		return fmt.Errorf("spool %s is full (%d bytes), dropping %d events", s.dir, atomic.LoadInt64(&s.curBytes), len(events))
+	}
+
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return fmt.Errorf("marshal spool record: %w", err)
+	}
+
+	s.segMux.Lock()
+	defer s.segMux.Unlock()
+
+	if s.activeSize >= CLICKHOUSE_DEFAULT_SPOOL_SEGMENT_SIZE {
+		if err := s.rotateLocked(); err != nil {
+			return err
+		}
+	}
+
+	var lenPrefix [4]byte
+	binary.BigEndian.PutUint32(lenPrefix[:], uint32(len(b)))
+
+	n1, err := s.activeFile.Write(lenPrefix[:])
+	if err != nil {
+		return fmt.Errorf("write spool record length: %w", err)
+	}
+	n2, err := s.activeFile.Write(b)
+	if err != nil {
+		return fmt.Errorf("write spool record: %w", err)
+	}
+
+	written := int64(n1 + n2)
+	s.activeSize += written
+	atomic.AddInt64(&s.curBytes, written)
+
+	glog.Infof("spooled %d events for table %s (retries=%d) to %s", len(events), table, retries, s.activePath)
+	return nil
+}
+
+// poison moves a record that has exhausted its retries into the poison
+// directory as its own file, with a sidecar .err file carrying why it died.
+func (s *clickhouseSpool) poison(rec *spoolRecord, cause error) error {
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return fmt.Errorf("marshal poisoned record: %w", err)
+	}
+
+	name := fmt.Sprintf("%d-%08x.batch", time.Now().UnixNano(), rand.Uint32())
+	path := filepath.Join(s.poisonDir, name)
+
+	if err := os.WriteFile(path, b, 0644); err != nil {
+		return fmt.Errorf("write poison batch %s: %w", path, err)
+	}
+	if err := os.WriteFile(path+".err", []byte(cause.Error()), 0644); err != nil {
+		glog.Errorf("write poison sidecar for %s error: %s", path, err)
+	}
+
+	glog.Errorf("moved %d events for table %s to poison queue: %s", len(rec.Events), rec.Table, cause)
+	return nil
+}
+
+// backoff is an exponential backoff with randomized jitter, in the style of
+// cenkalti/backoff: base * 2^attempt, capped, with +/- jitter fraction
+// applied on top.
+func (s *clickhouseSpool) backoff(attempt int) time.Duration {
+	d := s.backoffBase << uint(attempt)
+	if d <= 0 || d > s.backoffCap {
+		d = s.backoffCap
+	}
+	if s.jitter <= 0 {
+		return d
+	}
+	delta := float64(d) * s.jitter
+	return d + time.Duration(rand.Float64()*2*delta-delta)
+}
+
+// reap runs forever, periodically draining the oldest closed segment back
+// into bulkChan. It never touches the currently-active (still being
+// written) segment.
+func (s *clickhouseSpool) reap() {
+	ticker := time.NewTicker(s.reapInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := s.reapOldestSegment(); err != nil {
+			glog.Errorf("reap clickhouse spool error: %s", err)
+		}
+	}
+}
+
+func (s *clickhouseSpool) reapOldestSegment() error {
+	entries, err := os.ReadDir(s.pendingDir)
+	if err != nil {
+		return fmt.Errorf("read spool dir %s: %w", s.pendingDir, err)
+	}
+
+	type segment struct {
+		name string
+		seq  int64
+	}
+	segments := make([]segment, 0, len(entries))
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), ".log") {
+			continue
+		}
+		var seq int64
+		if _, err := fmt.Sscanf(e.Name(), "segment-%d.log", &seq); err != nil {
+			continue
+		}
+		segments = append(segments, segment{name: e.Name(), seq: seq})
+	}
+	if len(segments) == 0 {
+		return nil
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i].seq < segments[j].seq })
+
+	oldest := segments[0].name
+	oldestPath := filepath.Join(s.pendingDir, oldest)
+
+	s.segMux.Lock()
+	isActive := oldestPath == s.activePath
+	s.segMux.Unlock()
+	if isActive && len(segments) == 1 {
+		// Only the segment currently being written exists; nothing
+		// closed to reap yet.
+		return nil
+	}
+
+	return s.reapSegmentFile(oldestPath)
+}
+
+// reapSegmentFile reads every record in path, re-enqueues the ones whose
+// backoff has elapsed, and rewrites the segment with whatever is left
+// (records not yet due, or that bulkChan couldn't accept without blocking).
+func (s *clickhouseSpool) reapSegmentFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("open spool segment %s: %w", path, err)
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	var remaining []*spoolRecord
+	now := time.Now().Unix()
+
+	for {
+		var lenPrefix [4]byte
+		if _, err := io.ReadFull(r, lenPrefix[:]); err != nil {
+			break // EOF: end of segment
+		}
+		size := binary.BigEndian.Uint32(lenPrefix[:])
+		buf := make([]byte, size)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			glog.Errorf("truncated spool record in %s: %s", path, err)
+			break
+		}
+
+		rec := &spoolRecord{}
+		if err := json.Unmarshal(buf, rec); err != nil {
+			glog.Errorf("corrupt spool record in %s: %s", path, err)
+			continue
+		}
+
+		if rec.NextAttempt > now {
+			remaining = append(remaining, rec)
+			continue
+		}
+
+		select {
+		case s.bulkChan <- &ckBatch{events: rec.Events, retries: rec.Retries}:
+			atomic.AddInt64(&s.curBytes, -int64(len(buf)+4))
+		default:
+			// bulkChan is momentarily full; try again next tick.
+			remaining = append(remaining, rec)
+		}
+	}
+
+	return s.rewriteSegment(path, remaining)
+}
+
+// rewriteSegment replaces path with only the still-pending records, or
+// removes it entirely once it has fully drained.
+func (s *clickhouseSpool) rewriteSegment(path string, remaining []*spoolRecord) error {
+	s.segMux.Lock()
+	defer s.segMux.Unlock()
+
+	if len(remaining) == 0 {
+		if path == s.activePath {
+			// Never delete the file a concurrent write() may still be
+			// appending to; let it roll over naturally instead.
+			return nil
+		}
+		return os.Remove(path)
+	}
+
+	if path == s.activePath {
+		// The reaper only ever looks at closed segments (see
+		// reapOldestSegment), so this should not happen.
+		return nil
+	}
+
+	tmpPath := path + ".tmp"
+	f, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("create spool rewrite tmp %s: %w", tmpPath, err)
+	}
+
+	for _, rec := range remaining {
+		b, err := json.Marshal(rec)
+		if err != nil {
+			continue
+		}
+		var lenPrefix [4]byte
+		binary.BigEndian.PutUint32(lenPrefix[:], uint32(len(b)))
+		f.Write(lenPrefix[:])
+		f.Write(b)
+	}
+	f.Close()
+
+	return os.Rename(tmpPath, path)
+}
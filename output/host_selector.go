@@ -0,0 +1,236 @@
+package output
+
+import (
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// circuit breaker states for a single host.
+const (
+	circuitClosed int32 = iota
+	circuitOpen
+	circuitHalfOpen
+)
+
+func circuitStateString(state int32) string {
+	switch state {
+	case circuitOpen:
+		return "open"
+	case circuitHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+const (
+	CLICKHOUSE_DEFAULT_OPEN_DURATION    = 30 // seconds a host stays circuit-open before a half-open probe is allowed
+	CLICKHOUSE_DEFAULT_HALF_OPEN_PROBES = 1  // trial requests allowed while half-open
+)
+
+// HostSelector picks the next host a batch should be written to, and tracks
+// per-host health so a bad shard stops receiving traffic instead of being
+// retried in a tight loop. ReduceWeight/AddWeight are called by the output
+// on write failure/success; Stats is read by the metrics subsystem.
+type HostSelector interface {
+	Next() interface{}
+	Size() int
+	ReduceWeight(host interface{})
+	AddWeight(host interface{})
+	Stats() []HostStat
+}
+
+// HostStat is a point-in-time snapshot of one host's health, exported via
+// ClickhouseOutput.Stats() for the /metrics endpoint.
+type HostStat struct {
+	Host   string
+	Weight int
+	State  string
+}
+
+type hostEntry struct {
+	host interface{} // *sql.DB (http) or driver.Conn (native)
+	name string      // host address, for logs and Stats()
+
+	mux        sync.Mutex
+	weight     int
+	state      int32
+	openedAt   time.Time
+	probesLeft int
+}
+
+// rrHostSelector is a round-robin selector with a circuit breaker layered
+// on top. Weight does not change the selection order; it counts failures
+// down to the trip point: a host whose weight has been reduced to zero
+// trips open and is skipped by Next() until openDuration has elapsed, at
+// which point a bounded number of half-open probes are let through to
+// decide whether it goes back to closed (AddWeight) or open (ReduceWeight)
+// again. An AddWeight call (e.g. from the health checker) closes an open
+// circuit right away, before openDuration has elapsed.
+type rrHostSelector struct {
+	entries []*hostEntry
+
+	mux    sync.Mutex
+	cursor int
+
+	initWeight     int
+	openDuration   time.Duration
+	halfOpenProbes int
+}
+
+// NewRRHostSelector builds a round-robin HostSelector over hosts, labelled
+// by the matching entry in names for logging/Stats(). initWeight is both
+// the starting and maximum weight of every host; openDuration and
+// halfOpenProbes configure the circuit breaker (see ReduceWeight/Next).
+func NewRRHostSelector(hosts []interface{}, names []string, initWeight int, openDuration time.Duration, halfOpenProbes int) HostSelector {
+	entries := make([]*hostEntry, len(hosts))
+	for i, h := range hosts {
+		name := ""
+		if i < len(names) {
+			name = names[i]
+		}
+		entries[i] = &hostEntry{
+			host:   h,
+			name:   name,
+			weight: initWeight,
+			state:  circuitClosed,
+		}
+	}
+	return &rrHostSelector{
+		entries:        entries,
+		initWeight:     initWeight,
+		openDuration:   openDuration,
+		halfOpenProbes: halfOpenProbes,
+	}
+}
+
+func (s *rrHostSelector) Size() int {
+	return len(s.entries)
+}
+
+// Entries exposes every underlying host handle, for callers (the health
+// checker) that need to probe hosts directly rather than go through Next().
+func (s *rrHostSelector) Entries() []interface{} {
+	hosts := make([]interface{}, len(s.entries))
+	for i, e := range s.entries {
+		hosts[i] = e.host
+	}
+	return hosts
+}
+
+// eligible lazily flips a host from open to half-open once openDuration has
+// elapsed, and reports whether the host may currently be selected.
+func (e *hostEntry) eligible(openDuration time.Duration, halfOpenProbes int) bool {
+	e.mux.Lock()
+	defer e.mux.Unlock()
+
+	switch e.state {
+	case circuitClosed:
+		return true
+	case circuitOpen:
+		if time.Since(e.openedAt) < openDuration {
+			return false
+		}
+		e.state = circuitHalfOpen
+		e.probesLeft = halfOpenProbes
+		fallthrough
+	case circuitHalfOpen:
+		if e.probesLeft <= 0 {
+			return false
+		}
+		e.probesLeft--
+		return true
+	}
+	return false
+}
+
+// Next returns the next eligible host in round-robin order, or nil if every
+// host is currently circuit-open. Callers must treat a nil return as "no
+// host available right now" rather than a programming error.
+func (s *rrHostSelector) Next() interface{} {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	n := len(s.entries)
+	for i := 0; i < n; i++ {
+		idx := (s.cursor + i) % n
+		e := s.entries[idx]
+		if e.eligible(s.openDuration, s.halfOpenProbes) {
+			s.cursor = (idx + 1) % n
+			return e.host
+		}
+	}
+	return nil
+}
+
+func (s *rrHostSelector) find(host interface{}) *hostEntry {
+	for _, e := range s.entries {
+		if e.host == host {
+			return e
+		}
+	}
+	return nil
+}
+
+// ReduceWeight is called on Begin/Prepare/Exec/Commit failure. Once a host's
+// weight reaches zero it trips the circuit open; a failed half-open probe
+// sends it straight back to open and resets the timer.
+func (s *rrHostSelector) ReduceWeight(host interface{}) {
+	e := s.find(host)
+	if e == nil {
+		return
+	}
+
+	e.mux.Lock()
+	defer e.mux.Unlock()
+
+	if e.weight > 0 {
+		e.weight--
+	}
+
+	if e.state == circuitHalfOpen || e.weight == 0 {
+		if e.state != circuitOpen {
+			glog.Errorf("clickhouse host %s circuit opened (weight=%d)", e.name, e.weight)
+		}
+		e.state = circuitOpen
+		e.openedAt = time.Now()
+	}
+}
+
+// AddWeight is called on write success and by the health checker on a
+// successful `SELECT 1`. It restores weight up to initWeight and, for a
+// host that was open or half-open, closes the circuit.
+func (s *rrHostSelector) AddWeight(host interface{}) {
+	e := s.find(host)
+	if e == nil {
+		return
+	}
+
+	e.mux.Lock()
+	defer e.mux.Unlock()
+
+	if e.weight < s.initWeight {
+		e.weight++
+	}
+
+	if e.state != circuitClosed {
+		glog.Infof("clickhouse host %s circuit closed (weight=%d)", e.name, e.weight)
+		e.state = circuitClosed
+	}
+}
+
+func (s *rrHostSelector) Stats() []HostStat {
+	stats := make([]HostStat, len(s.entries))
+	for i, e := range s.entries {
+		e.mux.Lock()
+		stats[i] = HostStat{
+			Host:   e.name,
+			Weight: e.weight,
+			State:  circuitStateString(e.state),
+		}
+		e.mux.Unlock()
+	}
+	return stats
+}
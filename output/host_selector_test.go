@@ -0,0 +1,129 @@
+package output
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRRHostSelectorRoundRobin(t *testing.T) {
+	hosts := []interface{}{"a", "b", "c"}
+	s := NewRRHostSelector(hosts, []string{"a", "b", "c"}, 3, time.Minute, 1)
+
+	for i := 0; i < 6; i++ {
+		got := s.Next()
+		want := hosts[i%3]
+		if got != want {
+			t.Fatalf("Next() call %d = %v, want %v", i, got, want)
+		}
+	}
+}
+
+func TestRRHostSelectorCircuitOpensOnZeroWeight(t *testing.T) {
+	hosts := []interface{}{"a", "b"}
+	s := NewRRHostSelector(hosts, []string{"a", "b"}, 1, time.Minute, 1)
+
+	// Driving "a"'s weight to zero should trip its circuit open, leaving
+	// only "b" eligible from Next() regardless of round-robin order.
+	s.ReduceWeight("a")
+
+	for i := 0; i < 4; i++ {
+		if got := s.Next(); got != "b" {
+			t.Fatalf("Next() call %d = %v, want %v (host a should be circuit-open)", i, got, "b")
+		}
+	}
+}
+
+func TestRRHostSelectorNextNilWhenEveryHostOpen(t *testing.T) {
+	hosts := []interface{}{"a", "b"}
+	s := NewRRHostSelector(hosts, []string{"a", "b"}, 1, time.Minute, 1)
+
+	s.ReduceWeight("a")
+	s.ReduceWeight("b")
+
+	if got := s.Next(); got != nil {
+		t.Fatalf("Next() = %v, want nil when every host is circuit-open", got)
+	}
+}
+
+func TestRRHostSelectorHalfOpenProbeSucceeds(t *testing.T) {
+	hosts := []interface{}{"a"}
+	openDuration := 10 * time.Millisecond
+	s := NewRRHostSelector(hosts, []string{"a"}, 1, openDuration, 1)
+
+	s.ReduceWeight("a") // weight -> 0, circuit opens
+
+	if got := s.Next(); got != nil {
+		t.Fatalf("Next() = %v, want nil while circuit-open", got)
+	}
+
+	time.Sleep(2 * openDuration)
+
+	// First Next() after openDuration elapses should flip to half-open and
+	// let exactly one probe through.
+	if got := s.Next(); got != "a" {
+		t.Fatalf("Next() = %v, want %v for the half-open probe", got, "a")
+	}
+
+	// A successful probe (AddWeight) should close the circuit again.
+	s.AddWeight("a")
+
+	if got := s.Next(); got != "a" {
+		t.Fatalf("Next() = %v, want %v once the circuit is closed again", got, "a")
+	}
+}
+
+func TestRRHostSelectorHalfOpenProbeFailsReopens(t *testing.T) {
+	hosts := []interface{}{"a"}
+	openDuration := 10 * time.Millisecond
+	s := NewRRHostSelector(hosts, []string{"a"}, 1, openDuration, 1)
+
+	s.ReduceWeight("a") // weight -> 0, circuit opens
+	time.Sleep(2 * openDuration)
+
+	if got := s.Next(); got != "a" {
+		t.Fatalf("Next() = %v, want %v for the half-open probe", got, "a")
+	}
+
+	// A failed probe (ReduceWeight again while half-open) should send the
+	// host straight back to open and reset its timer.
+	s.ReduceWeight("a")
+
+	if got := s.Next(); got != nil {
+		t.Fatalf("Next() = %v, want nil: failed probe should reopen the circuit", got)
+	}
+}
+
+func TestRRHostSelectorAddWeightCapsAtInitWeight(t *testing.T) {
+	hosts := []interface{}{"a"}
+	s := NewRRHostSelector(hosts, []string{"a"}, 2, time.Minute, 1)
+
+	for i := 0; i < 5; i++ {
+		s.AddWeight("a")
+	}
+
+	stats := s.Stats()
+	if len(stats) != 1 {
+		t.Fatalf("expected 1 stat entry, got %d", len(stats))
+	}
+	if stats[0].Weight != 2 {
+		t.Errorf("Weight = %d, want capped at initWeight 2", stats[0].Weight)
+	}
+	if stats[0].State != "closed" {
+		t.Errorf("State = %q, want %q", stats[0].State, "closed")
+	}
+}
+
+func TestRRHostSelectorStatsReportsOpenState(t *testing.T) {
+	hosts := []interface{}{"a"}
+	s := NewRRHostSelector(hosts, []string{"a"}, 1, time.Minute, 1)
+
+	s.ReduceWeight("a")
+
+	stats := s.Stats()
+	if stats[0].State != "open" {
+		t.Errorf("State = %q, want %q", stats[0].State, "open")
+	}
+	if stats[0].Weight != 0 {
+		t.Errorf("Weight = %d, want 0", stats[0].Weight)
+	}
+}